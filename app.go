@@ -2,29 +2,34 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"regexp"
-	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/darkhelmet/ForrestFire/bookmarklet"
 	"github.com/darkhelmet/ForrestFire/looper"
 	"github.com/darkhelmet/env"
+	"github.com/darkhelmet/mercury"
 	"github.com/darkhelmet/postmark"
 	"github.com/darkhelmet/tinderizer"
 	"github.com/darkhelmet/tinderizer/cache"
 	J "github.com/darkhelmet/tinderizer/job"
+	"github.com/darkhelmet/tinderizer/kindlegen"
+	"github.com/darkhelmet/tinderizer/queue"
 	"github.com/darkhelmet/webutil"
 	"github.com/gorilla/mux"
 )
@@ -32,6 +37,7 @@ import (
 const (
 	HeaderAccessControlAllowOrigin = "Access-Control-Allow-Origin"
 	QueueSize                      = 10
+	MaxSubmissionSize              = 2 * J.MaxContentSize
 
 	HttpRedirect = "http.redirect"
 
@@ -43,6 +49,7 @@ const (
 
 	ContentType           = "Content-Type"
 	Location              = "Location"
+	RetryAfter            = "Retry-After"
 	ContentTypeHTML       = "text/html; charset=utf-8"
 	ContentTypePlain      = "text/plain; charset=utf-8"
 	ContentTypeJavascript = "application/javascript; charset=utf-8"
@@ -52,29 +59,56 @@ const (
 var (
 	doneRegex     = regexp.MustCompile("(?i:done|failed|limited|invalid|error|sorry)")
 	port          = env.IntDefault("PORT", 8080)
+	retryAfter    = env.IntDefault("RETRY_AFTER_SECONDS", 30)
 	canonicalHost = env.StringDefaultF("CANONICAL_HOST", func() string { return fmt.Sprintf("tinderizer.dev:%d", port) })
 	logger        = log.New(os.Stdout, "[server] ", env.IntDefault("LOG_FLAGS", log.LstdFlags|log.Lmicroseconds))
 	templates     = template.Must(template.ParseGlob("views/*.tmpl"))
 	app           *tinderizer.App
+	formats       = kindlegen.NewRegistry()
+	worker        = flag.Bool("worker", false, "run jobs from the shared queue instead of serving the site")
+
+	// The stats are for us, not the public. Without STATS_TOKEN there's
+	// no stats endpoint at all.
+	statsToken = env.StringDefault("STATS_TOKEN", "")
 )
 
 type JSON map[string]interface{}
 
 func init() {
+	flag.Parse()
+
 	redis := env.StringDefault("REDISCLOUD_URL", env.StringDefault("REDIS_PORT", ""))
+	redisOptions := env.StringDefault("REDIS_OPTIONS", "timeout=15s&maxidle=1")
 	if redis != "" {
-		cache.SetupRedis(redis, env.StringDefault("REDIS_OPTIONS", "timeout=15s&maxidle=1"))
+		cache.SetupRedis(redis, redisOptions)
 	}
 
-	mercuryToken := env.String("MERCURY_TOKEN")
+	mercuryToken := env.StringDefault("MERCURY_TOKEN", "")
+	mercury.Parser = env.StringDefault("MERCURY_PARSER", mercury.Parser)
 	pmToken := env.String("POSTMARK_TOKEN")
 	from := env.String("FROM")
-	binary, _ := exec.LookPath(fmt.Sprintf("kindlegen-%s", runtime.GOOS))
+	for _, tool := range strings.Fields(env.StringDefault("CONVERTERS", "kindlegen ebook-convert pandoc")) {
+		if binary, err := formats.Detect(tool); err != nil {
+			logger.Printf("converter %s unavailable: %s", tool, err)
+		} else {
+			logger.Printf("converting with %s", binary)
+		}
+	}
 
 	tlogger := log.New(os.Stdout, "[tinderizer] ", env.IntDefault("LOG_FLAGS", log.LstdFlags|log.Lmicroseconds))
 
-	app = tinderizer.New(mercuryToken, pmToken, from, binary, tlogger)
-	app.Run(QueueSize)
+	app = tinderizer.New(mercuryToken, pmToken, from, formats, tlogger)
+	shared := sharedQueue(redis, redisOptions)
+	switch {
+	case shared != nil && *worker:
+		app.Work(shared, QueueSize)
+	case shared != nil:
+		app.Distribute(shared)
+	case *worker:
+		logger.Fatalf("workers need a shared queue: set JOB_QUEUE=redis and a Redis URL")
+	default:
+		app.Run(QueueSize)
+	}
 
 	// TODO: handle SIGINT
 	c := make(chan os.Signal, 1)
@@ -82,6 +116,19 @@ func init() {
 	go shutdown(c)
 }
 
+// sharedQueue connects to the Redis job queue, if jobs are meant to be
+// handed off to worker processes through one.
+func sharedQueue(redis, options string) *queue.Redis {
+	if redis == "" || env.StringDefault("JOB_QUEUE", "local") != "redis" {
+		return nil
+	}
+	shared, err := queue.Dial(cache.RedisURL(redis, options), queue.Name, queue.Visibility)
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	return shared
+}
+
 func shutdown(c chan os.Signal) {
 	<-c
 	logger.Println("shutting down...")
@@ -114,6 +161,16 @@ func (r Response) JSON() http.ResponseWriter {
 	return r.ResponseWriter
 }
 
+// Busy turns a request away until there's room for it, telling the client
+// when to try again.
+func (r Response) Busy(contentType string) http.ResponseWriter {
+	h := r.Header()
+	h.Set(ContentType, contentType)
+	h.Set(RetryAfter, strconv.Itoa(retryAfter))
+	r.WriteHeader(http.StatusServiceUnavailable)
+	return r.ResponseWriter
+}
+
 func (r Response) Plain() http.ResponseWriter {
 	h := r.Header()
 	h.Set(ContentType, ContentTypePlain)
@@ -190,7 +247,9 @@ func ExtractParts(e *InboundEmail) (email string, url string, err error) {
 	if len(parts) == 0 {
 		return "", "", errors.New("failed splitting email on '@'")
 	}
-	emailBytes, err := hex.DecodeString(parts[0])
+	// Drop any +format mailbox hash
+	mailbox := strings.SplitN(parts[0], "+", 2)[0]
+	emailBytes, err := hex.DecodeString(mailbox)
 	if err != nil {
 		return "", "", fmt.Errorf("failed decoding email from hex: %s", err)
 	}
@@ -205,6 +264,18 @@ func ExtractParts(e *InboundEmail) (email string, url string, err error) {
 	return
 }
 
+// InboundFormat picks the requested format out of an email, either from the
+// mailbox hash (hex+epub@...) or the subject line. Anything unrecognized,
+// or that nothing here can make, gets the default.
+func InboundFormat(e *InboundEmail) J.Format {
+	for _, candidate := range []string{e.MailboxHash, e.Subject} {
+		if format, err := J.ParseFormat(candidate); err == nil && format != "" && formats.Supports(format) {
+			return format
+		}
+	}
+	return ""
+}
+
 func InboundHandler(res Response, req *http.Request) {
 	decoder := json.NewDecoder(req.Body)
 	var inbound InboundEmail
@@ -218,7 +289,15 @@ func InboundHandler(res Response, req *http.Request) {
 		} else {
 			logger.Printf("email submission of %#v to %#v", url, email)
 			if job, err := J.New(email, url); err == nil {
-				app.Queue(*job)
+				job.Format = InboundFormat(&inbound)
+				if err := app.Queue(*job); err == tinderizer.BusyError {
+					// Postmark tries again later when it doesn't get an OK.
+					logger.Printf("too busy for email submission of %#v", url)
+					io.WriteString(res.Busy(ContentTypePlain), "busy")
+					return
+				} else if err != nil {
+					logger.Printf("failed queueing email submission: %s", err)
+				}
 			}
 		}
 	}
@@ -246,8 +325,9 @@ func BounceHandler(res Response, req *http.Request) {
 		uri := looper.MarkResent(bounce.MessageID, bounce.Email)
 		if job, err := J.New(bounce.Email, uri); err != nil {
 			logger.Printf("bounced email failed to validate as a job: %s", err)
+		} else if err := app.Queue(*job); err != nil {
+			logger.Printf("failed queueing resend after bounce: %s", err)
 		} else {
-			app.Queue(*job)
 			logger.Printf("resending %#v to %#v after bounce", uri, bounce.Email)
 		}
 	}
@@ -256,47 +336,111 @@ func BounceHandler(res Response, req *http.Request) {
 }
 
 type Submission struct {
-	Url     string `json:"url"`
-	Email   string `json:"email"`
-	Content string `json:"content"`
+	Url      string `json:"url"`
+	Email    string `json:"email"`
+	Content  string `json:"content"`
+	Format   string `json:"format"`
+	Endnotes bool   `json:"endnotes"`
 }
 
 func SubmitHandler(res Response, req *http.Request) {
-	decoder := json.NewDecoder(req.Body)
-	var submission Submission
-	if err := decoder.Decode(&submission); err != nil {
+	submission, err := decodeSubmission(req.Body)
+	if err != nil {
 		logger.Printf("failed decoding submission: %s", err)
 	} else {
-		logger.Printf("submission of %#v to %#v", submission.Url, submission.Email)
+		logger.Printf("submission of %#v to %#v (%d bytes of content)", submission.Url, submission.Email, len(submission.Content))
 	}
 
-	w := res.JSON()
-	encoder := json.NewEncoder(w)
-	Submit(encoder, submission.Email, submission.Url)
+	Submit(res, submission.Email, submission.Url, submission.Content, submission.Format, submission.Endnotes)
+}
+
+// decodeSubmission reads a submission from the bookmarklet. One that's too
+// big to take, because of the page sent along with it, loses the page but
+// keeps the fields in front of it, so the URL can be fetched instead.
+func decodeSubmission(r io.Reader) (Submission, error) {
+	var submission Submission
+	body, err := ioutil.ReadAll(io.LimitReader(r, MaxSubmissionSize+1))
+	if err != nil {
+		return submission, err
+	}
+	if len(body) <= MaxSubmissionSize {
+		return submission, json.Unmarshal(body, &submission)
+	}
+
+	logger.Printf("dropping content from a submission over %d bytes", MaxSubmissionSize)
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if _, err := decoder.Token(); err != nil {
+		return submission, err
+	}
+	fields := make(map[string]json.RawMessage)
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			break
+		}
+		if name, ok := key.(string); ok && name != "content" {
+			fields[name] = value
+		}
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return submission, err
+	}
+	return submission, json.Unmarshal(data, &submission)
 }
 
 func OldSubmitHandler(res Response, req *http.Request) {
-	w := res.JSON()
-	encoder := json.NewEncoder(w)
 	email := req.URL.Query().Get("email")
 	url := req.URL.Query().Get("url")
-	Submit(encoder, email, url)
+	format := req.URL.Query().Get("format")
+	endnotes, _ := strconv.ParseBool(req.URL.Query().Get("endnotes"))
+	Submit(res, email, url, "", format, endnotes)
 }
 
-func HandleSubmitError(encoder *json.Encoder, err error) {
+func HandleSubmitError(res Response, err error) {
 	logger.Printf("submit error: %s", err)
+	if err == tinderizer.BusyError {
+		encoder := json.NewEncoder(res.Busy(ContentTypeJSON))
+		encoder.Encode(JSON{"message": err.Error(), "busy": true})
+		return
+	}
+	encoder := json.NewEncoder(res.JSON())
 	encoder.Encode(JSON{"message": err.Error()})
 }
 
-func Submit(encoder *json.Encoder, email, url string) {
+func Submit(res Response, email, url, content, format string, endnotes bool) {
+	f, err := J.ParseFormat(format)
+	if err != nil {
+		HandleSubmitError(res, err)
+		return
+	}
+	if !formats.Supports(f) {
+		HandleSubmitError(res, kindlegen.UnsupportedError)
+		return
+	}
+
 	job, err := J.New(email, url)
 	if err != nil {
-		HandleSubmitError(encoder, err)
+		HandleSubmitError(res, err)
 		return
 	}
+	job.Format = f
+	job.Endnotes = endnotes
+
+	if err := job.SetContent(content); err != nil {
+		logger.Printf("ignoring content submitted with %#v: %s", url, err)
+	}
 
 	job.Progress("Working...")
-	app.Queue(*job)
+	if err := app.Queue(*job); err != nil {
+		HandleSubmitError(res, err)
+		return
+	}
+	encoder := json.NewEncoder(res.JSON())
 	encoder.Encode(JSON{
 		"message": "Submitted! Hang tight...",
 		"id":      job.Key.String(),
@@ -319,6 +463,23 @@ func StatusHandler(res Response, req *http.Request) {
 	})
 }
 
+// StatsHandler reports the pipeline's gauges to whoever has STATS_TOKEN,
+// sent as a bearer token or the token parameter.
+func StatsHandler(res Response, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(statsToken)) != 1 {
+		http.Error(res, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w := res.JSON()
+	encoder := json.NewEncoder(w)
+	encoder.Encode(JSON{"stages": app.Stats()})
+}
+
 type CanonicalHostHandler struct {
 	http.Handler
 }
@@ -337,8 +498,14 @@ func (c CanonicalHostHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 }
 
 func main() {
+	if *worker {
+		logger.Printf("Tinderizer is working through the shared queue")
+		select {}
+	}
+
 	submitRoute := "/ajax/submit.json"
 	statusRoute := "/ajax/status/{id:[^.]+}.json"
+	statsRoute := "/ajax/stats.json"
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", H(HomeHandler)).Methods("GET")
@@ -350,13 +517,16 @@ func main() {
 	r.HandleFunc(submitRoute, H(SubmitHandler)).Methods("POST")
 	r.HandleFunc(submitRoute, H(OldSubmitHandler)).Methods("GET")
 	r.HandleFunc(statusRoute, H(StatusHandler)).Methods("GET")
+	if statsToken != "" {
+		r.HandleFunc(statsRoute, H(StatsHandler)).Methods("GET")
+	}
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("public")))
 
 	var handler http.Handler = r
-	handler = webutil.AlwaysHeaderHandler{handler, http.Header{HeaderAccessControlAllowOrigin: {"*"}}}
-	handler = webutil.GzipHandler{handler}
+	handler = webutil.AlwaysHeaderHandler{H: handler, Headers: http.Header{HeaderAccessControlAllowOrigin: {"*"}}}
+	handler = webutil.GzipHandler{H: handler}
 	handler = CanonicalHostHandler{handler}
-	handler = webutil.EnsureRequestBodyClosedHandler{handler}
+	handler = webutil.EnsureRequestBodyClosedHandler{H: handler}
 
 	http.Handle("/", handler)
 
@@ -5,11 +5,13 @@ import (
     JSON "encoding/json"
     "fmt"
     "github.com/darkhelmet/env"
+    J "github.com/darkhelmet/tinderizer/job"
     "github.com/darkhelmet/webcompiler"
     "io/ioutil"
     "log"
     "os"
     "os/signal"
+    "strconv"
     "syscall"
     "text/template"
 )
@@ -62,9 +64,10 @@ func compileCoffeeScript(compress bool) []byte {
     tmpl := template.Must(template.ParseFiles(CoffeeScriptPath))
 
     context := map[string]string{
-        "Style":    string(compileLessToJson(compress)),
-        "Protocol": protocol,
-        "Host":     host,
+        "Style":      string(compileLessToJson(compress)),
+        "Protocol":   protocol,
+        "Host":       host,
+        "MaxContent": strconv.Itoa(J.MaxContentSize),
     }
 
     var buffer bytes.Buffer